@@ -0,0 +1,181 @@
+// format.go
+//
+// Output backends for the tag index: the default Exuberant/universal
+// ctags format, GNU etags, JSON Lines, and universal-ctags' "-x"
+// cross-reference listing.  Each renders from the same []Tag, so the
+// AST-walking code never has to know which one is active.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	formatCtags = "ctags"
+	formatEtags = "etags"
+	formatJSON  = "json"
+	formatXref  = "xref"
+)
+
+// writeCtags renders tags in the original Exuberant-Ctags format, honoring
+// the extension fields enabled via --fields.
+func writeCtags(w io.Writer, tags []Tag) {
+	writeCtagsHeader(w)
+	for _, t := range tags {
+		fmt.Fprintln(w, ctagsLine(t))
+	}
+}
+
+// writeCtagsHeader writes just the !_TAG_* pseudo-tags, shared with the
+// incremental updater which assembles its tag lines separately.
+func writeCtagsHeader(w io.Writer) {
+	fmt.Fprintln(w, TAG_FILE_FORMAT)
+	fmt.Fprintln(w, TAG_FILE_SORTED)
+	fmt.Fprintln(w, TAG_FILE_ENCODING)
+	fmt.Fprintln(w, TAG_OUTPUT_MODE)
+	fmt.Fprintln(w, TAG_PROGRAM_AUTHOR)
+	fmt.Fprintln(w, TAG_PROGRAM_NAME)
+	fmt.Fprintln(w, TAG_PROGRAM_URL)
+	fmt.Fprintf(w, "!_TAG_PROGRAM_VERSION\t%s\n", *progVersion)
+	fmt.Fprintln(w, buildContextLine())
+}
+
+// ctagsLine renders a single tag as one Exuberant-Ctags line, honoring the
+// extension fields enabled via --fields.
+func ctagsLine(t Tag) string {
+	var extra []string
+	if fields['n'] {
+		extra = append(extra, fmt.Sprintf("line:%d", t.Line))
+	}
+	if fields['f'] && !isExported(t.Name) {
+		extra = append(extra, "file:")
+	}
+	if t.Package != "" {
+		extra = append(extra, "package:"+t.Package)
+	}
+	if t.Scope != "" {
+		extra = append(extra, t.Scope)
+	}
+	extra = append(extra, t.Extra...)
+	if fields['a'] {
+		access := "public"
+		if !isExported(t.Name) {
+			access = "private"
+		}
+		extra = append(extra, "access:"+access)
+	}
+	if fields['S'] && t.Signature != "" {
+		extra = append(extra, "signature:"+t.Signature)
+	}
+	if fields['t'] && t.Typeref != "" {
+		extra = append(extra, "typeref:typename:"+t.Typeref)
+	}
+	if t.Doc != "" {
+		extra = append(extra, "doc:"+strings.ReplaceAll(t.Doc, "\t", " "))
+	}
+
+	return fmt.Sprintf("%s\t%s\t/^%s$/;\"\t%c\t%s", t.Name, t.File, t.Pattern, t.Kind, strings.Join(extra, "\t"))
+}
+
+// writeEtags renders tags in GNU Emacs' etags format: one section per
+// file, each led by a form-feed, the filename and the byte size of the
+// section, followed by "name\x7fline,byte" entries.
+func writeEtags(w io.Writer, tags []Tag) {
+	byFile := make(map[string][]Tag)
+	var order []string
+	for _, t := range tags {
+		if _, ok := byFile[t.File]; !ok {
+			order = append(order, t.File)
+		}
+		byFile[t.File] = append(byFile[t.File], t)
+	}
+
+	for _, file := range order {
+		var body strings.Builder
+		for _, t := range byFile[file] {
+			fmt.Fprintf(&body, "%s\x7f%d,%d\n", t.Name, t.Line, t.Offset)
+		}
+		fmt.Fprintf(w, "\x0c\n%s,%d\n%s", file, body.Len(), body.String())
+	}
+}
+
+// jsonTag is the shape written by --format=json, one object per line.
+type jsonTag struct {
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Col       int    `json:"col"`
+	Kind      string `json:"kind"`
+	Scope     string `json:"scope,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Doc       string `json:"doc,omitempty"`
+}
+
+// writeJSON renders tags as JSON Lines, one object per tag, for
+// consumption by editor plugins and other LSP-adjacent tooling.
+func writeJSON(w io.Writer, tags []Tag) {
+	enc := json.NewEncoder(w)
+	for _, t := range tags {
+		enc.Encode(jsonTag{
+			Name:      t.Name,
+			File:      t.File,
+			Line:      t.Line,
+			Col:       t.Column,
+			Kind:      kindName(t.Kind),
+			Scope:     t.Scope,
+			Signature: t.Signature,
+			Doc:       t.Doc,
+		})
+	}
+}
+
+// writeXref renders tags in universal-ctags' "-x" cross-reference format:
+// name, kind, line number, file and the source line, column-aligned.
+func writeXref(w io.Writer, tags []Tag) {
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	for _, t := range tags {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", t.Name, kindName(t.Kind), t.Line, t.File, t.Pattern)
+	}
+	tw.Flush()
+}
+
+// isExported reports whether a tag name is exported, the way ast.IsExported
+// does, but judged by the final selector component — an embedded qualified
+// type such as "io.Writer" carries its package qualifier in t.Name, and
+// ast.IsExported("io.Writer") would inspect the leading "i" and mislabel it
+// as unexported.
+func isExported(name string) bool {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return ast.IsExported(name)
+}
+
+// kindName maps a single-letter ctags kind to the long-form name
+// universal-ctags uses in --fields=+K and -x output.
+func kindName(kind rune) string {
+	switch kind {
+	case CLASS:
+		return "interface"
+	case CONST:
+		return "constant"
+	case FUNC:
+		return "function"
+	case MEMBER:
+		return "member"
+	case STRUCT:
+		return "struct"
+	case TYPE:
+		return "type"
+	case VAR:
+		return "variable"
+	default:
+		return "unknown"
+	}
+}
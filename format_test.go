@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func sampleTags() []Tag {
+	return []Tag{
+		{Name: "Foo", Kind: FUNC, File: "a.go", Line: 3, Column: 1, Offset: 20, Pattern: "func Foo() {}", Package: "sample", Signature: "()"},
+		{Name: "Bar", Kind: STRUCT, File: "a.go", Line: 7, Column: 1, Offset: 60, Pattern: "type Bar struct {}", Package: "sample"},
+	}
+}
+
+func TestWriteEtagsGroupsByFileWithByteSize(t *testing.T) {
+	var buf bytes.Buffer
+	writeEtags(&buf, sampleTags())
+
+	out := buf.String()
+	// Both entries, "Foo\x7f3,20\n" and "Bar\x7f7,60\n", are 9 bytes long.
+	if !strings.HasPrefix(out, "\x0c\na.go,18\n") {
+		t.Fatalf("expected an etags section header for a.go with byte size 18, got %q", out)
+	}
+	if !strings.Contains(out, "Foo\x7f3,20\n") || !strings.Contains(out, "Bar\x7f7,60\n") {
+		t.Errorf("expected etags entries for Foo and Bar, got %q", out)
+	}
+}
+
+func TestWriteJSONEmitsOneObjectPerTag(t *testing.T) {
+	var buf bytes.Buffer
+	writeJSON(&buf, sampleTags())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON lines, got %d: %q", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], `"name":"Foo"`) || !strings.Contains(lines[0], `"kind":"function"`) {
+		t.Errorf("expected Foo's JSON line to carry name and kind, got %q", lines[0])
+	}
+}
+
+func TestCtagsLineAccessUsesFinalSelectorOfEmbeddedName(t *testing.T) {
+	oldFields := fields
+	fields = parseFields("+a")
+	defer func() { fields = oldFields }()
+
+	tag := Tag{Name: "io.Writer", Kind: MEMBER, File: "a.go", Line: 4, Scope: "struct:Thing", Extra: []string{"embedded:io.Writer"}}
+	line := ctagsLine(tag)
+
+	if !strings.Contains(line, "access:public") {
+		t.Errorf("expected an embedded io.Writer to be access:public, got %q", line)
+	}
+}
+
+func TestWriteXrefIncludesKindAndLine(t *testing.T) {
+	var buf bytes.Buffer
+	writeXref(&buf, sampleTags())
+
+	out := buf.String()
+	if !strings.Contains(out, "Foo") || !strings.Contains(out, "function") || !strings.Contains(out, "3") {
+		t.Errorf("expected Foo's xref line to carry its name, kind and line number, got %q", out)
+	}
+}
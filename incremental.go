@@ -0,0 +1,156 @@
+// incremental.go
+//
+// Incremental tag database updates (--update): only source files whose
+// content hash has changed since the last run are re-parsed, and prior
+// tag lines are carried over verbatim for everything else.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cacheFileName is the sidecar alongside the tags file that remembers each
+// source file's content hash between runs.
+const cacheFileName = ".taggo-cache"
+
+// runIncrementalUpdate re-parses only the source files that changed since
+// the last --update run against tagsFile, merges their tags with the
+// prior run's unchanged ones, and rewrites both the tags file and its
+// hash cache.
+func runIncrementalUpdate(tagsFile string) error {
+	cachePath := filepath.Join(filepath.Dir(tagsFile), cacheFileName)
+
+	prevHashes, err := loadCache(cachePath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", cachePath, err)
+	}
+	reusable := loadReusableLines(tagsFile)
+
+	discoverFiles()
+
+	newHashes := make(map[string]string, len(files))
+	var stale []string
+	var reusedLines []string
+
+	for _, file := range files {
+		hash, err := hashFile(file)
+		if err != nil {
+			continue // Skip unreadable files, same as parseFileList does.
+		}
+		newHashes[file] = hash
+
+		if lines, ok := reusable[file]; ok && prevHashes[file] == hash {
+			reusedLines = append(reusedLines, lines...)
+			continue
+		}
+		stale = append(stale, file)
+	}
+
+	fset := token.NewFileSet()
+	pkgs, _ := parseFileList(fset, stale)
+	tags := walkPackages(fset, pkgs)
+
+	lines := reusedLines
+	for _, t := range tags {
+		lines = append(lines, ctagsLine(t))
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	writeCtagsHeader(&buf)
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(tagsFile, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", tagsFile, err)
+	}
+
+	return saveCache(cachePath, newHashes)
+}
+
+// hashFile computes a source file's content hash using the "Hash1" scheme
+// go.sum uses: sha256 the file's bytes, then sha256 the single
+// "hash  path\n" line, base64-encoded with an "h1:" prefix.
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	inner := sha256.Sum256(data)
+	line := fmt.Sprintf("%x  %s\n", inner, filepath.ToSlash(path))
+	outer := sha256.Sum256([]byte(line))
+	return "h1:" + base64.StdEncoding.EncodeToString(outer[:]), nil
+}
+
+// loadCache reads the sidecar hash cache, keyed by source file path. A
+// missing cache file yields an empty cache rather than an error, since
+// that's simply the first run.
+func loadCache(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	cache := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		hash, file, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		cache[file] = hash
+	}
+	return cache, nil
+}
+
+// saveCache writes the hash cache back out, one "hash  path" line per
+// file sorted by path, mirroring go.sum's own layout.
+func saveCache(path string, cache map[string]string) error {
+	paths := make([]string, 0, len(cache))
+	for p := range cache {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "%s  %s\n", cache[p], p)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// loadReusableLines reads a previously-written ctags file and groups its
+// tag lines by source file, so unchanged files can be carried over
+// verbatim instead of being re-parsed.  A missing or unreadable tags file
+// simply yields no reusable lines, forcing a full parse.
+func loadReusableLines(tagsFile string) map[string][]string {
+	data, err := os.ReadFile(tagsFile)
+	if err != nil {
+		return nil
+	}
+
+	byFile := make(map[string][]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "!_") {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		byFile[parts[1]] = append(byFile[parts[1]], line)
+	}
+	return byFile
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashFileStableAndSensitiveToContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(path, []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h1, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _ := hashFile(path)
+	if h1 != h2 {
+		t.Errorf("expected a stable hash for unchanged content, got %q and %q", h1, h2)
+	}
+	if !strings.HasPrefix(h1, "h1:") {
+		t.Errorf("expected an h1: prefixed hash, got %q", h1)
+	}
+
+	if err := os.WriteFile(path, []byte("package a\n\nvar X int\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h3, _ := hashFile(path)
+	if h3 == h1 {
+		t.Errorf("expected the hash to change after editing the file")
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, cacheFileName)
+
+	want := map[string]string{
+		"a.go": "h1:aaaa",
+		"b.go": "h1:bbbb",
+	}
+	if err := saveCache(path, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || got["a.go"] != want["a.go"] || got["b.go"] != want["b.go"] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLoadCacheMissingFileIsEmpty(t *testing.T) {
+	cache, err := loadCache(filepath.Join(t.TempDir(), "does-not-exist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 0 {
+		t.Errorf("expected an empty cache, got %v", cache)
+	}
+}
+
+func TestRunIncrementalUpdateReusesUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	aPath := filepath.Join(dir, "a.go")
+	bPath := filepath.Join(dir, "b.go")
+	tagsPath := filepath.Join(dir, "tags")
+
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(aPath, "package sample\n\nfunc Foo() int { return 1 }\n")
+	write(bPath, "package sample\n\nfunc Bar() int { return 2 }\n")
+
+	oldFiles := files
+	defer func() { files = oldFiles }()
+
+	// discoverFiles() reads flag.Args(), which carries no positional
+	// arguments under `go test`; presetting files bypasses it and drives
+	// runIncrementalUpdate over exactly these two fixture files.
+	run := func() string {
+		files = []string{aPath, bPath}
+		if err := runIncrementalUpdate(tagsPath); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.ReadFile(tagsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	first := run()
+	if !strings.Contains(first, "Foo\t") || !strings.Contains(first, "Bar\t") {
+		t.Fatalf("expected tags for both Foo and Bar, got %q", first)
+	}
+
+	// Mark a.go's tag line in the tags file: a re-parse would regenerate
+	// it without the marker, so finding the marked line after editing only
+	// b.go proves it was reused verbatim rather than re-parsed.
+	fooLine := lineContaining(first, "Foo\t") + "\tmarker:reused"
+	write(tagsPath, strings.Replace(first, lineContaining(first, "Foo\t"), fooLine, 1))
+
+	write(bPath, "package sample\n\nfunc Bar() int { return 2 }\n\nfunc Baz() int { return 3 }\n")
+	second := run()
+
+	if lineContaining(second, "Foo\t") != fooLine {
+		t.Errorf("expected a.go's Foo tag line to be reused verbatim, got %q", lineContaining(second, "Foo\t"))
+	}
+	if !strings.Contains(second, "Baz\t") {
+		t.Errorf("expected a tag for the newly added Baz, got %q", second)
+	}
+}
+
+func lineContaining(text, substr string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
@@ -7,26 +7,37 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/doc"
 	"go/parser"
+	"go/printer"
 	"go/token"
-	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 )
 
 const (
 	TAG_FILE_FORMAT    = "!_TAG_FILE_FORMAT\t2"
 	TAG_FILE_SORTED    = "!_TAG_FILE_SORTED\t1"
+	TAG_FILE_ENCODING  = "!_TAG_FILE_ENCODING\tutf-8"
+	TAG_OUTPUT_MODE    = "!_TAG_OUTPUT_MODE\tu-ctags"
 	TAG_PROGRAM_AUTHOR = "!_TAG_PROGRAM_AUTHOR\tArjen Laarhoven"
 	TAG_PROGRAM_NAME   = "!_TAG_PROGRAM_NAME\ttaggo"
 	TAG_PROGRAM_URL    = "!_TAG_PROGRAM_URL\thttps://github.com/ArjenL/taggo"
 
+	// defaultFields lists the extension fields written when --fields is
+	// not given, using the same letters as universal-ctags: (n)line,
+	// (a)access, (S)ignature, (t)typeref.
+	defaultFields = "naSt"
+
 	CLASS  = 'c' // Interface ('class')
 	CONST  = 'd' // Constant ('#define')
 	FUNC   = 'f' // Function
@@ -38,46 +49,250 @@ const (
 
 var (
 	recurseSubdirs = flag.Bool("recurse", false, "Recurse into given subdirectories")
+	fieldsFlag     = flag.String("fields", "", "Control which extension fields are written, universal-ctags style (e.g. +KSl, -a, naSt)")
+	progVersion    = flag.String("program-version", "1.0", "Value reported in the !_TAG_PROGRAM_VERSION pseudo-tag")
+	formatFlag     = flag.String("format", formatCtags, "Output format: ctags, etags, json, or xref")
+	updateFlag     = flag.String("update", "", "Incrementally update the given ctags file instead of writing to stdout")
+
+	goosFlag   = flag.String("goos", "", "GOOS to evaluate build constraints against (default: runtime.GOOS)")
+	goarchFlag = flag.String("goarch", "", "GOARCH to evaluate build constraints against (default: runtime.GOARCH)")
+	tagsFlag   = flag.String("tags", "", "Comma or space separated build tags, as in go build -tags")
+	testsFlag  = flag.Bool("tests", false, "Include _test.go files")
 
 	files = make([]string, 0)
-	tags  = make([]string, 0)
+
+	fields = parseFields(*fieldsFlag)
 )
 
+// numWorkers bounds the parsing and tag-extraction worker pools to the
+// number of available processors, so taggo doesn't spawn a goroutine per
+// file on large trees.
+func numWorkers() int {
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		return n
+	}
+	return 1
+}
+
 func main() {
 	flag.Parse()
+	fields = parseFields(*fieldsFlag)
+
+	if *updateFlag != "" {
+		if err := runIncrementalUpdate(*updateFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "taggo:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Parse the given files.
 	fset := token.NewFileSet()
 	pkgs, _ := parseFiles(fset)
+	tags := walkPackages(fset, pkgs)
 
-	// Extract toplevel declaration information from the packages.
+	// Render the tags, sorted alphabetically, in the requested format.
+	switch *formatFlag {
+	case formatEtags:
+		writeEtags(os.Stdout, tags)
+	case formatJSON:
+		writeJSON(os.Stdout, tags)
+	case formatXref:
+		writeXref(os.Stdout, tags)
+	default:
+		writeCtags(os.Stdout, tags)
+	}
+}
+
+// walkPackages extracts declaration information from parsed packages,
+// descending into function bodies to pick up nested and local
+// declarations too.  Each file is independent, so they're handed to a
+// bounded worker pool; idx and lc are shared and safe for concurrent use.
+func walkPackages(fset *token.FileSet, pkgs map[string]*ast.Package) []Tag {
+	idx := &TagIndex{}
+	lc := &lineCache{lines: make(map[string][][]byte)}
+
+	sem := make(chan struct{}, numWorkers())
+	var wg sync.WaitGroup
 	for _, pkg := range pkgs {
-		for _, file := range pkg.Files {
-			handleDecls(fset, file.Decls)
+		for filename, file := range pkg.Files {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(filename string, file *ast.File, pkgName string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				cmap := ast.NewCommentMap(fset, file, file.Comments)
+				ast.Walk(&visitor{fset: fset, pkgName: pkgName, idx: idx, lc: lc, cmap: cmap}, file)
+			}(filename, file, pkg.Name)
 		}
 	}
+	wg.Wait()
+
+	return idx.sorted()
+}
+
+// Tag is the structured record of a single indexed symbol.  Every output
+// backend renders from the same Tag value, so the AST-walking code never
+// branches on --format.
+type Tag struct {
+	Name      string
+	Kind      rune
+	File      string
+	Line      int
+	Column    int
+	Offset    int
+	Pattern   string // literal source text of the declaration's line
+	Package   string
+	Scope     string // e.g. "class:Foo", "struct:Foo", "inherits:A,B"
+	Signature string
+	Typeref   string
+	Doc       string   // first sentence of the associated doc comment, go/doc.Synopsis-style
+	Extra     []string // extension fields the caller already knows the key for, e.g. "embedded:Base"
+}
 
-	// Output the tags sorted alphabetically.
-	sort.Strings(tags)
-	printTagsHeader()
-	for _, t := range tags {
-		fmt.Printf("%s\n", t)
+// TagIndex collects tags produced by concurrent file visitors behind a
+// mutex, replacing the single-threaded package-level slice.
+type TagIndex struct {
+	mu   sync.Mutex
+	tags []Tag
+}
+
+func (idx *TagIndex) add(tag Tag) {
+	idx.mu.Lock()
+	idx.tags = append(idx.tags, tag)
+	idx.mu.Unlock()
+}
+
+// sorted returns the indexed tags sorted by name, the way ctags sorts its
+// output; ties are broken by file and line so the result is stable.
+func (idx *TagIndex) sorted() []Tag {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	sorted := make([]Tag, len(idx.tags))
+	copy(sorted, idx.tags)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].File != sorted[j].File {
+			return sorted[i].File < sorted[j].File
+		}
+		return sorted[i].Line < sorted[j].Line
+	})
+	return sorted
+}
+
+// lineCache slurps each source file once and serves /^.../ search strings
+// from the cached lines, instead of re-opening the file for every tag.
+type lineCache struct {
+	mu    sync.Mutex
+	lines map[string][][]byte
+}
+
+func (c *lineCache) contentOfLine(line int, file string) []byte {
+	c.mu.Lock()
+	ls, ok := c.lines[file]
+	if !ok {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			ls = bytes.Split(data, []byte("\n"))
+		}
+		c.lines[file] = ls
+	}
+	c.mu.Unlock()
+
+	if line < 1 || line > len(ls) {
+		return []byte("")
 	}
+	return ls[line-1]
+}
+
+// visitor walks a whole file with ast.Walk so that declarations are found
+// wherever they occur: at top level, nested inside other type specs, or
+// local to a function body.  A *ast.GenDecl's token (CONST/VAR/TYPE) and
+// the decl itself are passed explicitly down to its own Specs rather than
+// kept as shared mutable state on v, since a nested GenDecl inside one
+// spec's initializer (e.g. a local type declared in a closure assigned to
+// a var) must not corrupt a sibling spec still to be visited.  cmap
+// associates doc comments with the declarations they describe, for the
+// doc: extension field.
+type visitor struct {
+	fset    *token.FileSet
+	pkgName string
+	idx     *TagIndex
+	lc      *lineCache
+	cmap    ast.CommentMap
 }
 
-func handleDecls(fset *token.FileSet, decls []ast.Decl) {
-	for _, decl := range decls {
-		switch decl := decl.(type) {
-		case *ast.FuncDecl:
-			funcDecl(fset, decl)
-		case *ast.GenDecl:
-			genDecl(fset, decl)
+func (v *visitor) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		v.funcDecl(n)
+	case *ast.GenDecl:
+		v.genDecl(n)
+		return nil // Specs, and anything nested inside them, are walked above.
+	}
+	return v
+}
+
+// genDecl handles a const/var/type declaration by iterating its own Specs
+// with the decl's token passed explicitly, then walking each spec (and
+// whatever it contains) with the same visitor so nested declarations are
+// still found.
+func (v *visitor) genDecl(decl *ast.GenDecl) {
+	for _, spec := range decl.Specs {
+		switch s := spec.(type) {
+		case *ast.TypeSpec:
+			v.typeSpec(s, decl)
+		case *ast.ValueSpec:
+			v.valueSpec(s, decl.Tok, decl)
 		}
+		ast.Walk(v, spec)
 	}
 }
 
+// docInfo returns the go/doc.Synopsis-style first sentence of the doc
+// comment associated with the first of nodes that has one — callers pass a
+// spec first and its enclosing *ast.GenDecl as a fallback, since a doc
+// comment on an unparenthesized "type Foo struct {...}" attaches to the
+// GenDecl rather than the TypeSpec.  It also reports any taggo:ignore or
+// taggo:kind=<x> pragma found in that comment's raw text.
+func (v *visitor) docInfo(nodes ...ast.Node) (synopsis string, ignore bool, kind rune) {
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		groups := v.cmap[n]
+		if len(groups) == 0 {
+			continue
+		}
+		text := groups[0].Text()
+		ignore, kind = pragmasOf(text)
+		return doc.Synopsis(text), ignore, kind
+	}
+	return "", false, 0
+}
+
+// pragmasOf scans a doc comment's raw text for "taggo:ignore" and
+// "taggo:kind=<x>" pragma lines, letting generated code suppress its own
+// tags or reclassify a symbol — e.g. an interface-like struct tagged as
+// CLASS instead of STRUCT.
+func pragmasOf(text string) (ignore bool, kind rune) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "taggo:ignore":
+			ignore = true
+		case strings.HasPrefix(line, "taggo:kind="):
+			if k := strings.TrimPrefix(line, "taggo:kind="); len(k) == 1 {
+				kind = rune(k[0])
+			}
+		}
+	}
+	return
+}
+
 // Handle a function declaration.
-func funcDecl(fset *token.FileSet, decl *ast.FuncDecl) {
+func (v *visitor) funcDecl(decl *ast.FuncDecl) {
 	var recvType string
 	if decl.Recv != nil {
 		// Method definition.  There's always only one receiver.
@@ -86,98 +301,235 @@ func funcDecl(fset *token.FileSet, decl *ast.FuncDecl) {
 		// Normal function
 		recvType = ""
 	}
-	emitTag(decl.Name.Name, decl.Pos(), fset, FUNC, recvType)
-}
 
-// Handle CONST, TYPE or VAR declarations
-func genDecl(fset *token.FileSet, decl *ast.GenDecl) {
-	for _, spec := range decl.Specs {
-		switch nt := spec.(type) {
-		case *ast.TypeSpec:
-			typeSpec(fset, nt)
+	docText, ignore, kindOverride := v.docInfo(decl)
+	if ignore {
+		return
+	}
+	kind := FUNC
+	if kindOverride != 0 {
+		kind = kindOverride
+	}
+	v.idx.emitTag(v.lc, decl.Name.Name, decl.Pos(), v.fset, kind, v.pkgName, recvType, signatureOf(v.fset, decl.Type), "", docText)
 
-		case *ast.ValueSpec:
-			for _, ident := range nt.Names {
-				var kind rune
-				switch decl.Tok {
-				case token.CONST:
-					kind = CONST
-				case token.VAR:
-					kind = VAR
-				}
-				emitTag(ident.Name, ident.NamePos, fset, kind, "")
+	v.namedResults(decl)
+}
+
+// namedResults emits a VAR tag, scoped to the enclosing function, for each
+// named return value (e.g. "err" in "func F() (sum int, err error)"), so
+// they're surfaced the same way named parameters would be instead of
+// vanishing entirely.
+func (v *visitor) namedResults(decl *ast.FuncDecl) {
+	if decl.Type.Results == nil {
+		return
+	}
+	scope := fmt.Sprintf("function:%s", decl.Name.Name)
+	for _, f := range decl.Type.Results.List {
+		var typeref string
+		if f.Type != nil {
+			typeref = typeName(f.Type)
+		}
+		for _, name := range f.Names {
+			if name.Name == "_" {
+				continue
 			}
+			v.idx.emitTag(v.lc, name.Name, name.NamePos, v.fset, VAR, v.pkgName, scope, "", typeref, "")
 		}
 	}
 }
 
-// Handle structures/"classes" (interfaces)
-func typeSpec(fset *token.FileSet, spec *ast.TypeSpec) {
+// Handle a CONST or VAR spec, given the token and the *ast.GenDecl of the
+// enclosing declaration.
+func (v *visitor) valueSpec(nt *ast.ValueSpec, tok token.Token, genDecl *ast.GenDecl) {
+	var kind rune
+	switch tok {
+	case token.CONST:
+		kind = CONST
+	case token.VAR:
+		kind = VAR
+	default:
+		return
+	}
+
+	docText, ignore, kindOverride := v.docInfo(nt, genDecl)
+	if ignore {
+		return
+	}
+	if kindOverride != 0 {
+		kind = kindOverride
+	}
+
+	var typeref string
+	if nt.Type != nil {
+		typeref = typeName(nt.Type)
+	}
+	for _, ident := range nt.Names {
+		if ident.Name == "_" {
+			continue
+		}
+		v.idx.emitTag(v.lc, ident.Name, ident.NamePos, v.fset, kind, v.pkgName, "", "", typeref, docText)
+	}
+}
+
+// Handle structures/"classes" (interfaces), wherever the TypeSpec occurs,
+// given the *ast.GenDecl it belongs to (for the doc: fallback).
+func (v *visitor) typeSpec(spec *ast.TypeSpec, genDecl *ast.GenDecl) {
+	docText, ignore, kindOverride := v.docInfo(spec, genDecl)
+
 	switch st := spec.Type.(type) {
 	case *ast.StructType:
-		emitTag(spec.Name.Name, st.Pos(), fset, STRUCT, "")
+		if ignore {
+			return
+		}
+		kind := STRUCT
+		if kindOverride != 0 {
+			kind = kindOverride
+		}
+		v.idx.emitTag(v.lc, spec.Name.Name, st.Pos(), v.fset, kind, v.pkgName, "", "", "", docText)
 		for _, f := range st.Fields.List {
+			fieldDoc, fieldIgnore, fieldKindOverride := v.docInfo(f)
+			if fieldIgnore {
+				continue
+			}
+			fieldKind := MEMBER
+			if fieldKindOverride != 0 {
+				fieldKind = fieldKindOverride
+			}
+			if len(f.Names) == 0 {
+				// Anonymous (embedded) field: the field name is the
+				// embedded type's own name.
+				name := typeName(f.Type)
+				if name != "" {
+					v.idx.emitTag(v.lc, name, f.Pos(), v.fset, fieldKind, v.pkgName, fmt.Sprintf("struct:%s", spec.Name.Name), "", "", fieldDoc, "embedded:"+name)
+				}
+				continue
+			}
 			for _, m := range f.Names {
-				emitTag(m.Name, m.Pos(), fset, MEMBER, fmt.Sprintf("struct:%s", spec.Name.Name))
+				v.idx.emitTag(v.lc, m.Name, m.Pos(), v.fset, fieldKind, v.pkgName, fmt.Sprintf("struct:%s", spec.Name.Name), "", "", fieldDoc)
 			}
 		}
 	case *ast.InterfaceType:
-		emitTag(spec.Name.Name, st.Pos(), fset, CLASS, "")
+		if ignore {
+			return
+		}
+		var embeds []string
 		for _, f := range st.Methods.List {
+			if len(f.Names) == 0 {
+				// Embedded interface rather than a method.
+				embeds = append(embeds, typeName(f.Type))
+				continue
+			}
+			methodDoc, methodIgnore, _ := v.docInfo(f)
+			if methodIgnore {
+				continue
+			}
 			for _, m := range f.Names {
-				emitTag(m.Name, m.Pos(), fset, FUNC, fmt.Sprintf("class:%s", spec.Name.Name))
+				v.idx.emitTag(v.lc, m.Name, m.Pos(), v.fset, FUNC, v.pkgName, fmt.Sprintf("class:%s", spec.Name.Name), "", "", methodDoc)
 			}
 		}
+		scope := ""
+		if len(embeds) > 0 {
+			scope = "inherits:" + strings.Join(embeds, ",")
+		}
+		kind := CLASS
+		if kindOverride != 0 {
+			kind = kindOverride
+		}
+		v.idx.emitTag(v.lc, spec.Name.Name, st.Pos(), v.fset, kind, v.pkgName, scope, "", "", docText)
 	default:
-		emitTag(spec.Name.Name, st.Pos(), fset, TYPE, "")
+		kind := TYPE
+		if kindOverride != 0 {
+			kind = kindOverride
+		}
+		if !ignore {
+			v.idx.emitTag(v.lc, spec.Name.Name, st.Pos(), v.fset, kind, v.pkgName, "", "", "", docText)
+		}
 	}
-
 }
 
-// Add tag to the map of tags
-func emitTag(tag string, pos token.Pos, fset *token.FileSet, kind rune, extra string) {
+// Record a tag.  pkgName, scope, signature and typeref carry the metadata
+// that feeds the ctags extension fields (package:, class:/struct:,
+// signature:, typeref:); doc is the comment synopsis for the doc: field.
+// extraFields are appended verbatim, for callers with extension fields of
+// their own (e.g. embedded: on anonymous struct fields).  Gating by
+// --fields happens at render time, in ctagsLine.
+func (idx *TagIndex) emitTag(lc *lineCache, name string, pos token.Pos, fset *token.FileSet, kind rune, pkgName, scope, signature, typeref, doc string, extraFields ...string) {
 	p := fset.Position(pos)
-	searchString := contentOfLine(p.Line, p.Filename)
-	tags = append(tags, fmt.Sprintf("%s\t%s\t/^%s$/;\"\t%c\t%s", tag, p.Filename, searchString, kind, extra))
+	idx.add(Tag{
+		Name:      name,
+		Kind:      kind,
+		File:      p.Filename,
+		Line:      p.Line,
+		Column:    p.Column,
+		Offset:    p.Offset,
+		Pattern:   string(lc.contentOfLine(p.Line, p.Filename)),
+		Package:   pkgName,
+		Scope:     scope,
+		Signature: signature,
+		Typeref:   typeref,
+		Doc:       doc,
+		Extra:     extraFields,
+	})
 }
 
-// Return the content from the given line number of the given file.
-func contentOfLine(line int, file string) []byte {
-	var cl []byte
-	ln := 1
-
-	f, err := os.Open(file)
-	if err != nil {
-		// Just skip over the file when we can't open it
-		return []byte("")
+// Render a function or method signature as "(params) results", the way
+// universal-ctags' signature: field does, by printing the func's param
+// and result lists and stripping the leading "func" keyword.
+func signatureOf(fset *token.FileSet, typ *ast.FuncType) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, typ); err != nil {
+		return ""
 	}
-	defer f.Close()
+	return strings.TrimPrefix(buf.String(), "func")
+}
 
-	r := bufio.NewReader(f)
+// parseFields turns a --fields argument into the set of enabled field
+// letters.  An empty spec yields defaultFields.  A spec starting with '+'
+// or '-' adjusts the default set; anything else replaces it outright,
+// matching universal-ctags' --fields semantics.
+func parseFields(spec string) map[rune]bool {
+	enabled := make(map[rune]bool)
+	for _, c := range defaultFields {
+		enabled[c] = true
+	}
+	if spec == "" {
+		return enabled
+	}
 
-	for {
-		cl, err = r.ReadBytes('\n')
-		if err == io.EOF && ln < line {
-			// File has fewer lines than <line>
-			return []byte("")
+	if spec[0] != '+' && spec[0] != '-' {
+		enabled = make(map[rune]bool)
+		for _, c := range spec {
+			enabled[c] = true
 		}
+		return enabled
+	}
 
-		// Are we there yet?
-		if ln == line {
-			// Remove the trailing newline
-			if len(cl) > 0 {
-				cl = cl[:len(cl)-1]
-			}
-			return cl
+	add := true
+	for _, c := range spec {
+		switch c {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			enabled[c] = add
 		}
-
-		ln++
 	}
+	return enabled
 }
 
-// Parse the files given on the command-line
+// Parse the files given on the command-line.
 func parseFiles(fset *token.FileSet) (map[string]*ast.Package, error) {
-	// Expand the content of given subdirs into a list of files.
+	discoverFiles()
+	return parseFileList(fset, files)
+}
+
+// discoverFiles expands the command-line arguments into the package-level
+// files slice: regular .go files are taken as-is, and directories are
+// scanned with appendPackageFiles, recursing into subdirectories when
+// --recurse is given.
+func discoverFiles() {
+	ctx := buildContext()
 	for _, fn := range flag.Args() {
 		fi, err := os.Stat(fn)
 		if err != nil {
@@ -186,50 +538,144 @@ func parseFiles(fset *token.FileSet) (map[string]*ast.Package, error) {
 
 		if fi.Mode().IsRegular() && filepath.Ext(fn) == ".go" {
 			files = append(files, fn)
+			continue
 		}
 
-		if *recurseSubdirs && fi.IsDir() {
-			filepath.Walk(fi.Name(), walker)
+		if !fi.IsDir() {
+			continue
 		}
-	}
 
-	var pkgs = make(map[string]*ast.Package)
-	var first error
-
-	for _, filename := range files {
-		if src, err := parser.ParseFile(fset, filename, nil, parser.SpuriousErrors); err == nil {
-			name := src.Name.Name
-			pkg, found := pkgs[name]
-			if !found {
-				pkg = &ast.Package{
-					Name:  name,
-					Files: make(map[string]*ast.File),
+		appendPackageFiles(ctx, fn)
+		if *recurseSubdirs {
+			filepath.Walk(fn, func(path string, sub os.FileInfo, err error) error {
+				if err != nil || path == fn || !sub.IsDir() {
+					return nil
 				}
-				pkgs[name] = pkg
-			}
-			pkg.Files[filename] = src
-		} else if first == nil {
-			first = err
+				appendPackageFiles(ctx, path)
+				return nil
+			})
 		}
 	}
-	return pkgs, first
 }
 
-// Walker function for filepath.Walk
-func walker(path string, fi os.FileInfo, err error) error {
-	if fi.Mode()&os.ModeType == 0 && strings.HasSuffix(fi.Name(), ".go") {
-		files = append(files, path)
+// buildContext returns the go/build.Context that file discovery evaluates
+// build constraints against, applying --goos, --goarch and --tags on top
+// of build.Default the same way "go build" applies GOOS/GOARCH/-tags.
+func buildContext() *build.Context {
+	ctx := build.Default
+	if *goosFlag != "" {
+		ctx.GOOS = *goosFlag
+	}
+	if *goarchFlag != "" {
+		ctx.GOARCH = *goarchFlag
+	}
+	if *tagsFlag != "" {
+		ctx.BuildTags = strings.FieldsFunc(*tagsFlag, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
 	}
-	return nil
+	return &ctx
 }
 
-// Output the tag header to standard output
-func printTagsHeader() {
-	fmt.Println(TAG_FILE_FORMAT)
-	fmt.Println(TAG_FILE_SORTED)
-	fmt.Println(TAG_PROGRAM_AUTHOR)
-	fmt.Println(TAG_PROGRAM_NAME)
-	fmt.Println(TAG_PROGRAM_URL)
+// appendPackageFiles adds dir's build-constraint-matching .go files to the
+// package-level files slice, using ctx's GOOS/GOARCH/tags the way "go
+// build" would; _test.go files are only added when --tests is set.  A
+// directory with no buildable Go source (or that can't be read) is simply
+// skipped, matching discoverFiles' existing handling of bad paths.
+func appendPackageFiles(ctx *build.Context, dir string) {
+	pkg, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		if _, ok := err.(*build.MultiplePackageError); !ok {
+			return
+		}
+	}
+
+	for _, name := range pkg.GoFiles {
+		files = append(files, filepath.Join(dir, name))
+	}
+	for _, name := range pkg.CgoFiles {
+		files = append(files, filepath.Join(dir, name))
+	}
+	if *testsFlag {
+		for _, name := range pkg.TestGoFiles {
+			files = append(files, filepath.Join(dir, name))
+		}
+		for _, name := range pkg.XTestGoFiles {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+}
+
+// buildContextLine renders the !_TAG_BUILD_CONTEXT pseudo-tag recording the
+// effective GOOS/GOARCH/tags/tests used for file discovery, so downstream
+// tools can tell which build variant produced a given tags file.
+func buildContextLine() string {
+	ctx := buildContext()
+	return fmt.Sprintf("!_TAG_BUILD_CONTEXT\tgoos=%s goarch=%s tags=%s tests=%t",
+		ctx.GOOS, ctx.GOARCH, strings.Join(ctx.BuildTags, ","), *testsFlag)
+}
+
+// parseFileList parses the given files concurrently across a bounded
+// worker pool, grouping the results by package.  token.FileSet is safe for
+// concurrent use, so workers can share fset directly; the single goroutine
+// draining results is the only one touching pkgs.
+func parseFileList(fset *token.FileSet, filenames []string) (map[string]*ast.Package, error) {
+	type parsed struct {
+		filename string
+		file     *ast.File
+		err      error
+	}
+
+	jobs := make(chan string)
+	results := make(chan parsed)
+
+	n := numWorkers()
+	var workers sync.WaitGroup
+	workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer workers.Done()
+			for filename := range jobs {
+				src, err := parser.ParseFile(fset, filename, nil, parser.ParseComments|parser.SpuriousErrors)
+				results <- parsed{filename, src, err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, filename := range filenames {
+			jobs <- filename
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var pkgs = make(map[string]*ast.Package)
+	var first error
+
+	for r := range results {
+		if r.err != nil {
+			if first == nil {
+				first = r.err
+			}
+			continue
+		}
+		name := r.file.Name.Name
+		pkg, found := pkgs[name]
+		if !found {
+			pkg = &ast.Package{
+				Name:  name,
+				Files: make(map[string]*ast.File),
+			}
+			pkgs[name] = pkg
+		}
+		pkg.Files[r.filename] = r.file
+	}
+	return pkgs, first
 }
 
 // Return the name of the type as string.  This routine is borrowed from the
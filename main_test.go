@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sync"
+	"testing"
+)
+
+// walkFixture parses src as a standalone Go file and runs it through the
+// visitor, returning the resulting tags.  It uses a fresh TagIndex and
+// lineCache, and resets the field set, so tests don't see each other's
+// output.
+func walkFixture(t *testing.T, src string) []Tag {
+	t.Helper()
+
+	fields = parseFields("")
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "fixture.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+
+	idx := &TagIndex{}
+	lc := &lineCache{lines: map[string][][]byte{"fixture.go": bytes.Split([]byte(src), []byte("\n"))}}
+	cmap := ast.NewCommentMap(fset, file, file.Comments)
+	ast.Walk(&visitor{fset: fset, pkgName: file.Name.Name, idx: idx, lc: lc, cmap: cmap}, file)
+	return idx.sorted()
+}
+
+// tagNamed returns the first tag with the given name, if any.
+func tagNamed(tags []Tag, name string) (Tag, bool) {
+	for _, t := range tags {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tag{}, false
+}
+
+// tagNamedKind returns the first tag with the given name and kind, if any.
+func tagNamedKind(tags []Tag, name string, kind rune) (Tag, bool) {
+	for _, t := range tags {
+		if t.Name == name && t.Kind == kind {
+			return t, true
+		}
+	}
+	return Tag{}, false
+}
+
+func TestVisitorEmbeddedStructField(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+type Base struct {
+	ID int
+}
+
+type Widget struct {
+	Base
+	Name string
+}
+`)
+
+	tag, ok := tagNamedKind(tags, "Base", MEMBER)
+	if !ok {
+		t.Fatalf("expected a member tag named Base, got %v", tags)
+	}
+	if tag.Scope != "struct:Widget" {
+		t.Errorf("expected Base to be scoped to struct:Widget, got %q", tag.Scope)
+	}
+	if len(tag.Extra) != 1 || tag.Extra[0] != "embedded:Base" {
+		t.Errorf("expected Base to carry embedded:Base, got %v", tag.Extra)
+	}
+}
+
+func TestVisitorEmbeddedInterface(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+type Reader interface {
+	Read(p []byte) (int, error)
+}
+
+type ReadCloser interface {
+	Reader
+	Close() error
+}
+`)
+
+	rc, ok := tagNamed(tags, "ReadCloser")
+	if !ok {
+		t.Fatalf("expected a tag named ReadCloser, got %v", tags)
+	}
+	if rc.Scope != "inherits:Reader" {
+		t.Errorf("expected ReadCloser to inherit Reader, got %q", rc.Scope)
+	}
+
+	closeTag, ok := tagNamed(tags, "Close")
+	if !ok {
+		t.Fatalf("expected a tag named Close, got %v", tags)
+	}
+	if closeTag.Scope != "class:ReadCloser" {
+		t.Errorf("expected Close to be scoped to class:ReadCloser, got %q", closeTag.Scope)
+	}
+}
+
+func TestVisitorNestedLocalTypeDecl(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+func Factory() int {
+	type localCounter struct {
+		n int
+	}
+	var c localCounter
+	return c.n
+}
+`)
+
+	if _, ok := tagNamed(tags, "localCounter"); !ok {
+		t.Errorf("expected a tag for the function-local type, got %v", tags)
+	}
+
+	c, ok := tagNamed(tags, "c")
+	if !ok {
+		t.Fatalf("expected a tag for the local variable c, got %v", tags)
+	}
+	if c.Typeref != "localCounter" {
+		t.Errorf("expected c to be typed localCounter, got %q", c.Typeref)
+	}
+}
+
+func TestVisitorDocSynopsis(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+// Greet says hello to name.
+// It never returns an error.
+func Greet(name string) string { return "hello " + name }
+`)
+
+	tag, ok := tagNamed(tags, "Greet")
+	if !ok {
+		t.Fatalf("expected a tag named Greet, got %v", tags)
+	}
+	if tag.Doc != "Greet says hello to name." {
+		t.Errorf("expected the first sentence of the doc comment, got %q", tag.Doc)
+	}
+}
+
+func TestVisitorTaggoIgnorePragma(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+// Generated holds generated state.
+//
+// taggo:ignore
+type Generated struct {
+	Field int
+	inner string
+}
+
+// Gen behaves like an interface despite being generated.
+//
+// taggo:ignore
+type Gen interface {
+	Foo()
+	Bar()
+}
+`)
+
+	if _, ok := tagNamed(tags, "Generated"); ok {
+		t.Errorf("expected Generated to be suppressed by taggo:ignore, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "Field"); ok {
+		t.Errorf("expected Generated's field Field to be suppressed along with its type, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "inner"); ok {
+		t.Errorf("expected Generated's field inner to be suppressed along with its type, got %v", tags)
+	}
+
+	if _, ok := tagNamed(tags, "Gen"); ok {
+		t.Errorf("expected Gen to be suppressed by taggo:ignore, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "Foo"); ok {
+		t.Errorf("expected Gen's method Foo to be suppressed along with its type, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "Bar"); ok {
+		t.Errorf("expected Gen's method Bar to be suppressed along with its type, got %v", tags)
+	}
+}
+
+func TestVisitorTaggoKindPragma(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+// Handle behaves like an interface despite being a struct.
+//
+// taggo:kind=c
+type Handle struct {
+	X int
+}
+`)
+
+	tag, ok := tagNamed(tags, "Handle")
+	if !ok {
+		t.Fatalf("expected a tag named Handle, got %v", tags)
+	}
+	if tag.Kind != CLASS {
+		t.Errorf("expected taggo:kind=c to reclassify Handle as CLASS, got %q", string(tag.Kind))
+	}
+}
+
+func TestVisitorGenDeclDoesNotLeakTokenAcrossNestedDecl(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+var (
+	A = func() {
+		type LocalT int
+		_ = LocalT(0)
+	}
+	B int
+)
+`)
+
+	if _, ok := tagNamed(tags, "A"); !ok {
+		t.Errorf("expected a tag for A, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "LocalT"); !ok {
+		t.Errorf("expected a tag for the nested local type LocalT, got %v", tags)
+	}
+	if _, ok := tagNamed(tags, "B"); !ok {
+		t.Errorf("expected a tag for B, but it was dropped; got %v", tags)
+	}
+}
+
+func TestVisitorFuncDeclNamedResults(t *testing.T) {
+	tags := walkFixture(t, `package sample
+
+func F() (sum int, err error) {
+	return
+}
+`)
+
+	sum, ok := tagNamedKind(tags, "sum", VAR)
+	if !ok {
+		t.Fatalf("expected a var tag named sum, got %v", tags)
+	}
+	if sum.Scope != "function:F" {
+		t.Errorf("expected sum to be scoped to function:F, got %q", sum.Scope)
+	}
+	if sum.Typeref != "int" {
+		t.Errorf("expected sum to be typed int, got %q", sum.Typeref)
+	}
+
+	errTag, ok := tagNamedKind(tags, "err", VAR)
+	if !ok {
+		t.Fatalf("expected a var tag named err, got %v", tags)
+	}
+	if errTag.Scope != "function:F" {
+		t.Errorf("expected err to be scoped to function:F, got %q", errTag.Scope)
+	}
+}
+
+func TestTagIndexConcurrentAdd(t *testing.T) {
+	idx := &TagIndex{}
+
+	var wg sync.WaitGroup
+	const n = 200
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			idx.add(Tag{Name: "tag", Line: i})
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(idx.sorted()); got != n {
+		t.Errorf("expected %d tags, got %d", n, got)
+	}
+}